@@ -0,0 +1,85 @@
+// Copyright 2015 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Client is one websocket connection, subscribed to a Server shared with
+// every other client on the same workspace root and server profile.
+type Client struct {
+	server *Server
+	ws     *websocket.Conn
+
+	// send is the queue of framed JSON-RPC messages waiting to be written
+	// to ws. It is closed by Server.unregister once the client has been
+	// removed from every subscriber set.
+	send chan []byte
+}
+
+// readPump reads JSON-RPC messages from the websocket and forwards them to
+// the client's server. It blocks until the connection is closed.
+func (c *Client) readPump() {
+	defer func() {
+		_ = c.ws.Close()
+	}()
+
+	c.ws.SetReadLimit(*maxMessageSize)
+	if err := c.ws.SetReadDeadline(time.Now().Add(pongWait)); err != nil {
+		return
+	}
+	c.ws.SetPongHandler(func(string) error {
+		return c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, message, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := c.server.forward(c, message); err != nil {
+			log.Println("forward:", err)
+		}
+	}
+}
+
+// writePump relays messages queued on c.send, plus periodic pings, to the
+// websocket. It returns when a write fails or send is closed.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		_ = c.ws.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			if err := c.ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+				return
+			}
+			if !ok {
+				_ = c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				time.Sleep(closeGracePeriod)
+				return
+			}
+			traceCompressionSizes(message)
+			if err := c.ws.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.ws.SetWriteDeadline(time.Now().Add(writeWait)); err != nil {
+				return
+			}
+			if err := c.ws.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		}
+	}
+}
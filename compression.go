@@ -0,0 +1,93 @@
+// Copyright 2015 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	enableCompression = flag.Bool("enable-compression", false, "enable permessage-deflate compression for websocket connections")
+	compressionLevel  = flag.Int("compression-level", 1, "deflate compression level (1-9) used when compression is enabled")
+	readBufferSize    = flag.Int("read-buffer-size", 4096, "websocket upgrader read buffer size, in bytes")
+	writeBufferSize   = flag.Int("write-buffer-size", 4096, "websocket upgrader write buffer size, in bytes")
+	allowedOrigins    = flag.String("allowed-origins", "", "comma-separated list of allowed Origin header values; empty restricts to the request's own Host")
+	verbose           = flag.Bool("v", false, "log verbose diagnostics, including compression trace")
+)
+
+// newUpgrader builds the websocket.Upgrader from flags. It must be called
+// after flag.Parse.
+func newUpgrader() websocket.Upgrader {
+	return websocket.Upgrader{
+		ReadBufferSize:    *readBufferSize,
+		WriteBufferSize:   *writeBufferSize,
+		EnableCompression: *enableCompression,
+		CheckOrigin:       checkOrigin,
+	}
+}
+
+// checkOrigin implements websocket.Upgrader.CheckOrigin against the
+// -allowed-origins flag. With no flag set it falls back to the same
+// same-origin check gorilla/websocket itself uses by default: a missing
+// Origin, or one whose host matches the request's own Host. That default
+// must stay this strict, not "allow everything" — /ws spawns a process,
+// so any browser page able to open a cross-origin connection to it can
+// drive that process.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if *allowedOrigins == "" {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+		return strings.EqualFold(u.Host, r.Host)
+	}
+
+	for _, allowed := range strings.Split(*allowedOrigins, ",") {
+		if strings.TrimSpace(allowed) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// traceCompressionSizes logs, when -v is set, how much smaller message
+// would be on the wire under deflate. It doesn't affect what is actually
+// sent; gorilla/websocket applies its own per-message compression when
+// EnableCompression is set on the upgrader and the connection.
+func traceCompressionSizes(message []byte) {
+	if !*verbose {
+		return
+	}
+
+	var buf bytes.Buffer
+	zw, err := flate.NewWriter(&buf, *compressionLevel)
+	if err != nil {
+		log.Println("trace compression:", err)
+		return
+	}
+	if _, err := zw.Write(message); err != nil {
+		log.Println("trace compression:", err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		log.Println("trace compression:", err)
+		return
+	}
+
+	log.Printf("compression trace: %d bytes -> %d bytes (%.1f%%)", len(message), buf.Len(), 100*float64(buf.Len())/float64(len(message)))
+}
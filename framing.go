@@ -0,0 +1,83 @@
+// Copyright 2015 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// defaultContentType is assumed when a framed message omits the
+// Content-Type header, per the LSP base protocol.
+const defaultContentType = "application/vscode-jsonrpc; charset=utf-8"
+
+// readFramedMessage reads one LSP base-protocol message from r: a block of
+// "Header: value\r\n" lines terminated by a blank line, followed by exactly
+// Content-Length bytes of body. It returns the body only; headers other than
+// Content-Length are not currently surfaced to callers.
+func readFramedMessage(r *bufio.Reader) ([]byte, error) {
+	contentLength := -1
+	sawHeader := false
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && !sawHeader {
+				return nil, io.EOF
+			}
+			return nil, errors.Wrap(err, "failed to read header")
+		}
+		sawHeader = true
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, errors.Errorf("malformed header line: %q", line)
+		}
+		value = strings.TrimSpace(value)
+
+		switch strings.TrimSpace(name) {
+		case "Content-Length":
+			contentLength, err = strconv.Atoi(value)
+			if err != nil {
+				return nil, errors.Wrap(err, "invalid Content-Length")
+			}
+		case "Content-Type":
+			// Accepted but otherwise unused.
+		}
+	}
+
+	if contentLength < 0 {
+		return nil, errors.New("missing Content-Length header")
+	}
+
+	body := make([]byte, contentLength)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errors.Wrap(err, "failed to read body")
+	}
+
+	return body, nil
+}
+
+// writeFramedMessage writes body to w with the LSP base-protocol
+// Content-Length and Content-Type headers.
+func writeFramedMessage(w io.Writer, body []byte) error {
+	if _, err := fmt.Fprintf(w, "Content-Length: %d\r\nContent-Type: %s\r\n\r\n", len(body), defaultContentType); err != nil {
+		return errors.Wrap(err, "failed to write header")
+	}
+	if _, err := w.Write(body); err != nil {
+		return errors.Wrap(err, "failed to write body")
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+)
+
+// serverKey identifies one running Server: its workspace root plus, in
+// registry mode, which named profile it is.
+type serverKey struct {
+	root string
+	name string
+}
+
+// Hub owns one Server per serverKey and hands new websocket connections
+// off to the right one, starting it on demand.
+//
+// h.mu is the single lock that serializes "does a server for this key
+// exist, and is it still accepting clients" across every goroutine: a
+// join can't land on a Server that a concurrent leave has just decided to
+// tear down, because both hold h.mu for the whole decision, not just the
+// map update.
+type Hub struct {
+	mu      sync.Mutex
+	servers map[serverKey]*Server
+}
+
+func newHub() *Hub {
+	return &Hub{servers: make(map[serverKey]*Server)}
+}
+
+// serveWs authenticates r, resolves which language server it wants, and
+// joins it (starting one if none is running yet) to the Server for the
+// workspace root given by the "root" query parameter (the current
+// directory if unset).
+func (h *Hub) serveWs(w http.ResponseWriter, r *http.Request) {
+	if !checkAuth(r, requiredAuthToken) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	name := r.URL.Query().Get("server")
+	cmd, args, ok := reg.resolve(name)
+	if !ok {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if reg == nil {
+		// Outside registry mode there is exactly one command, so an
+		// incidental ?server= value must not split clients on the same
+		// root into separate processes.
+		name = ""
+	}
+
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("upgrade:", err)
+		return
+	}
+
+	if *enableCompression {
+		ws.EnableWriteCompression(true)
+		if err := ws.SetCompressionLevel(*compressionLevel); err != nil {
+			log.Println("compression level:", err)
+		}
+	}
+
+	root := r.URL.Query().Get("root")
+	if root == "" {
+		root = "."
+	}
+
+	c := &Client{ws: ws, send: make(chan []byte, 256)}
+
+	srv, err := h.join(serverKey{root: root, name: name}, cmd, args, c)
+	if err != nil {
+		internalError(ws, "start:", err)
+		return
+	}
+	c.server = srv
+
+	go c.writePump()
+	c.readPump()
+
+	h.leave(srv, c)
+}
+
+// join finds or starts the Server for key and registers c with it, all
+// under h.mu, so a Server can never be removed from h.servers between a
+// caller observing it and registering.
+func (h *Hub) join(key serverKey, cmd string, args []string, c *Client) (*Server, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	srv, ok := h.servers[key]
+	if !ok {
+		var err error
+		srv, err = startServer(key, cmd, args)
+		if err != nil {
+			return nil, err
+		}
+		h.servers[key] = srv
+	}
+
+	srv.register(c)
+	return srv, nil
+}
+
+// leave unregisters c from s and, if s has no clients left, removes it
+// from the hub and tears its process down in the background. The
+// removal and the "is this the last client" check happen under the same
+// h.mu as join, so a new client can't be handed a Server that is about to
+// be torn down.
+func (h *Hub) leave(s *Server, c *Client) {
+	h.mu.Lock()
+	remaining := s.unregister(c)
+	if remaining == 0 && h.servers[s.key] == s {
+		delete(h.servers, s.key)
+	}
+	h.mu.Unlock()
+
+	if remaining == 0 {
+		go s.terminate()
+	}
+}
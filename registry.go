@@ -0,0 +1,116 @@
+// Copyright 2015 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	serversConfig = flag.String("servers-config", "", `path to a JSON file of named language server profiles, e.g. {"gopls": {"cmd": "gopls", "args": ["-mode=stdio"]}}; when set, clients pick one via /ws?server=<name> instead of the command line argument`)
+
+	authToken     = flag.String("auth-token", "", "bearer token required to open /ws; disabled if empty and -auth-token-file is unset")
+	authTokenFile = flag.String("auth-token-file", "", "path to a file containing the bearer token required to open /ws")
+)
+
+// serverProfile is one named entry of a -servers-config registry.
+type serverProfile struct {
+	Cmd  string   `json:"cmd"`
+	Args []string `json:"args"`
+}
+
+// registry holds the named server profiles loaded from -servers-config. A
+// nil registry means no config file was given, so the single command
+// fixed on the command line is used instead and names are ignored.
+type registry struct {
+	profiles map[string]serverProfile
+}
+
+func loadRegistry(path string) (*registry, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "read servers config")
+	}
+
+	var profiles map[string]serverProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, errors.Wrap(err, "parse servers config")
+	}
+
+	return &registry{profiles: profiles}, nil
+}
+
+// resolve looks up the command and arguments to run for the named profile.
+// ok is false if a registry is configured and name isn't in it; callers
+// should treat that as "not found" rather than spawning anything.
+func (reg *registry) resolve(name string) (cmd string, args []string, ok bool) {
+	if reg == nil {
+		return cmdPath, flag.Args()[1:], true
+	}
+
+	profile, found := reg.profiles[name]
+	if !found {
+		return "", nil, false
+	}
+
+	path, err := exec.LookPath(profile.Cmd)
+	if err != nil {
+		return "", nil, false
+	}
+
+	return path, profile.Args, true
+}
+
+// loadAuthToken resolves the bearer token required by checkAuth from
+// -auth-token-file or -auth-token. An empty result disables auth.
+func loadAuthToken() (string, error) {
+	if *authTokenFile != "" {
+		data, err := os.ReadFile(*authTokenFile)
+		if err != nil {
+			return "", errors.Wrap(err, "read auth token file")
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return *authToken, nil
+}
+
+// checkAuth reports whether r carries the configured bearer token, either
+// as "Authorization: Bearer <token>" or a "?token=<token>" query parameter.
+// An empty required token disables the check.
+func checkAuth(r *http.Request, required string) bool {
+	if required == "" {
+		return true
+	}
+
+	if tokensEqual(r.URL.Query().Get("token"), required) {
+		return true
+	}
+
+	const prefix = "Bearer "
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, prefix) {
+		return tokensEqual(strings.TrimPrefix(auth, prefix), required)
+	}
+
+	return false
+}
+
+// tokensEqual compares a and b in time independent of where they first
+// differ, so a bearer token can't be recovered byte-by-byte by timing
+// /ws requests.
+func tokensEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,435 @@
+// Copyright 2015 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// jsonrpcEnvelope extracts just enough of a JSON-RPC 2.0 message to route
+// it: whether it carries an id (a request or a response) and, for
+// requests/notifications, the method name and params.
+type jsonrpcEnvelope struct {
+	ID     json.RawMessage `json:"id,omitempty"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// pendingRequest remembers which client a forwarded request came from, and
+// under what id it knows the request by, so the response can be routed
+// back and re-keyed.
+type pendingRequest struct {
+	client *Client
+	id     json.RawMessage
+}
+
+// Server is one running language server process, shared by every websocket
+// client connected to the same workspace root and server profile.
+type Server struct {
+	key  serverKey
+	root string
+
+	proc *os.Process
+	done chan struct{}
+
+	stdin   *os.File
+	stdinMu sync.Mutex
+
+	// shutdownAck is closed when the language server responds to the
+	// shutdown request sent by terminate.
+	shutdownAck chan struct{}
+
+	// watcher is non-nil when -watch-files is set; it emits
+	// workspace/didChangeWatchedFiles notifications into stdin.
+	watcher *fileWatcher
+
+	mu      sync.Mutex
+	clients map[*Client]bool
+	nextID  uint64
+	pending map[uint64]pendingRequest
+	docSubs map[string]map[*Client]bool
+}
+
+// startServer launches cmd with args rooted at key.root and begins pumping
+// its stdout.
+func startServer(key serverKey, cmd string, args []string) (*Server, error) {
+	outr, outw, err := os.Pipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "stdout pipe")
+	}
+
+	inr, inw, err := os.Pipe()
+	if err != nil {
+		_ = outr.Close()
+		_ = outw.Close()
+		return nil, errors.Wrap(err, "stdin pipe")
+	}
+
+	proc, err := os.StartProcess(cmd, append([]string{cmd}, args...), &os.ProcAttr{
+		Dir:   key.root,
+		Files: []*os.File{inr, outw, outw},
+	})
+	if err != nil {
+		_ = outr.Close()
+		_ = outw.Close()
+		_ = inr.Close()
+		_ = inw.Close()
+		return nil, errors.Wrap(err, "start")
+	}
+
+	_ = inr.Close()
+	_ = outw.Close()
+
+	s := &Server{
+		key:         key,
+		root:        key.root,
+		proc:        proc,
+		stdin:       inw,
+		done:        make(chan struct{}),
+		shutdownAck: make(chan struct{}),
+		clients:     make(map[*Client]bool),
+		pending:     make(map[uint64]pendingRequest),
+		docSubs:     make(map[string]map[*Client]bool),
+	}
+
+	go s.readLoop(outr)
+
+	if *watchFiles {
+		fw, err := startFileWatcher(s)
+		if err != nil {
+			log.Println("watch:", err)
+		} else {
+			s.watcher = fw
+		}
+	}
+
+	return s, nil
+}
+
+func (s *Server) register(c *Client) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[c] = true
+}
+
+// unregister removes c and reports how many clients remain. Callers are
+// expected to be holding the Hub's lock (see Hub.leave), which is what
+// makes that count safe to act on: no client can join this Server between
+// unregister returning zero and the caller deciding to tear it down.
+func (s *Server) unregister(c *Client) int {
+	s.mu.Lock()
+	delete(s.clients, c)
+	for _, subs := range s.docSubs {
+		delete(subs, c)
+	}
+	remaining := len(s.clients)
+	s.mu.Unlock()
+
+	close(c.send)
+
+	return remaining
+}
+
+// forward sends a message from client c to the language server. A genuine
+// client request (one with both an id and a method) has its id rewritten
+// to one that is unique across every client sharing this server, and
+// records how to map the eventual response back. A response the client is
+// sending to a server-initiated request (an id with no method, e.g. an ack
+// for client/registerCapability) carries an id the server itself chose, so
+// it is passed through unchanged.
+func (s *Server) forward(c *Client, body []byte) error {
+	var env jsonrpcEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return errors.Wrap(err, "failed to parse client message")
+	}
+
+	if env.ID != nil && env.Method != "" {
+		s.mu.Lock()
+		s.nextID++
+		newID := s.nextID
+		s.pending[newID] = pendingRequest{client: c, id: env.ID}
+		s.mu.Unlock()
+
+		rewritten, err := setID(body, newID)
+		if err != nil {
+			return err
+		}
+		body = rewritten
+	}
+
+	if env.Method == "textDocument/didOpen" {
+		s.subscribe(c, env)
+	}
+
+	return s.writeStdin(body)
+}
+
+// writeStdin serializes framed writes to the language server's stdin.
+// Content-Length framing needs its header and body written as one unit;
+// without this lock, concurrent forward calls from different clients (or
+// the shutdown handshake, or the file watcher) can interleave their writes
+// and corrupt the stream.
+func (s *Server) writeStdin(body []byte) error {
+	s.stdinMu.Lock()
+	defer s.stdinMu.Unlock()
+	return writeFramedMessage(s.stdin, body)
+}
+
+// readLoop reads framed JSON-RPC messages from the server's stdout and
+// routes each one to the client(s) it belongs to.
+func (s *Server) readLoop(r *os.File) {
+	defer close(s.done)
+	defer func() {
+		_ = r.Close()
+	}()
+
+	br := bufio.NewReader(r)
+	for {
+		body, err := readFramedMessage(br)
+		if err != nil {
+			return
+		}
+		s.route(body)
+	}
+}
+
+func (s *Server) route(body []byte) {
+	var env jsonrpcEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		log.Println("route:", err)
+		return
+	}
+
+	if env.ID != nil && env.Method == "" {
+		s.reply(env, body)
+		return
+	}
+
+	if env.Method == "client/registerCapability" && s.watcher != nil {
+		s.watcher.learn(env)
+	}
+
+	s.broadcast(env, body)
+}
+
+// reply routes a response from the server back to the client that made the
+// original request, restoring the client's own id.
+func (s *Server) reply(env jsonrpcEnvelope, body []byte) {
+	var id uint64
+	if err := json.Unmarshal(env.ID, &id); err != nil {
+		log.Println("reply: unexpected id:", err)
+		return
+	}
+
+	s.mu.Lock()
+	pending, ok := s.pending[id]
+	delete(s.pending, id)
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	if pending.client == nil {
+		// This is the response to our own shutdown request, not a
+		// forwarded client request; see terminate.
+		close(s.shutdownAck)
+		return
+	}
+
+	rewritten, err := setIDRaw(body, pending.id)
+	if err != nil {
+		log.Println("reply:", err)
+		return
+	}
+
+	select {
+	case pending.client.send <- rewritten:
+	default:
+	}
+}
+
+// broadcast delivers a server-initiated notification (or request) to every
+// client subscribed to the document it concerns, or to all clients if it
+// isn't document-scoped.
+func (s *Server) broadcast(env jsonrpcEnvelope, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if uri := diagnosticsURI(env); uri != "" {
+		for c := range s.docSubs[uri] {
+			select {
+			case c.send <- body:
+			default:
+			}
+		}
+		return
+	}
+
+	for c := range s.clients {
+		select {
+		case c.send <- body:
+		default:
+		}
+	}
+}
+
+func (s *Server) subscribe(c *Client, env jsonrpcEnvelope) {
+	var params struct {
+		TextDocument struct {
+			URI string `json:"uri"`
+		} `json:"textDocument"`
+	}
+	if err := json.Unmarshal(env.Params, &params); err != nil || params.TextDocument.URI == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs, ok := s.docSubs[params.TextDocument.URI]
+	if !ok {
+		subs = make(map[*Client]bool)
+		s.docSubs[params.TextDocument.URI] = subs
+	}
+	subs[c] = true
+}
+
+func diagnosticsURI(env jsonrpcEnvelope) string {
+	if env.Method != "textDocument/publishDiagnostics" {
+		return ""
+	}
+	var params struct {
+		URI string `json:"uri"`
+	}
+	if err := json.Unmarshal(env.Params, &params); err != nil {
+		return ""
+	}
+	return params.URI
+}
+
+// terminate runs the LSP shutdown/exit handshake: a `shutdown` request,
+// then (once it responds) an `exit` notification, then waits for the
+// process to go away. A language server that doesn't play along within
+// the configured timeouts gets the old treatment: a signal, and a bigger
+// one if that doesn't work either.
+func (s *Server) terminate() {
+	stage, err := s.shutdownHandshake()
+	if err != nil {
+		log.Printf("server %s: %s failed (%v), falling back to signals", s.root, stage, err)
+		s.kill()
+	} else {
+		log.Printf("server %s: terminated cleanly via %s", s.root, stage)
+	}
+
+	if s.watcher != nil {
+		s.watcher.close()
+	}
+}
+
+func (s *Server) shutdownHandshake() (stage string, err error) {
+	s.mu.Lock()
+	s.nextID++
+	id := s.nextID
+	s.pending[id] = pendingRequest{}
+	s.mu.Unlock()
+
+	shutdownReq, err := json.Marshal(struct {
+		Jsonrpc string `json:"jsonrpc"`
+		ID      uint64 `json:"id"`
+		Method  string `json:"method"`
+	}{"2.0", id, "shutdown"})
+	if err != nil {
+		return "marshal shutdown", err
+	}
+	if err := s.writeStdin(shutdownReq); err != nil {
+		return "send shutdown", err
+	}
+
+	select {
+	case <-s.shutdownAck:
+	case <-s.done:
+		return "await shutdown response", errors.New("language server closed stdout before responding")
+	case <-time.After(*shutdownTimeout):
+		return "await shutdown response", errors.New("timed out")
+	}
+
+	exitNotif, err := json.Marshal(struct {
+		Jsonrpc string `json:"jsonrpc"`
+		Method  string `json:"method"`
+	}{"2.0", "exit"})
+	if err != nil {
+		return "marshal exit", err
+	}
+	if err := s.writeStdin(exitNotif); err != nil {
+		return "send exit", err
+	}
+
+	select {
+	case <-s.done:
+	case <-time.After(*exitTimeout):
+		return "await process exit", errors.New("timed out")
+	}
+
+	if _, err := s.proc.Wait(); err != nil {
+		log.Println("wait:", err)
+	}
+
+	return "exit", nil
+}
+
+// kill is the pre-handshake teardown: close stdin (some commands exit on
+// EOF), then a signal, then a bigger signal.
+func (s *Server) kill() {
+	_ = s.stdin.Close()
+
+	if err := s.proc.Signal(os.Interrupt); err != nil {
+		log.Println("inter:", err)
+	}
+
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		if err := s.proc.Signal(os.Kill); err != nil {
+			log.Println("term:", err)
+		}
+		<-s.done
+	}
+
+	if _, err := s.proc.Wait(); err != nil {
+		log.Println("wait:", err)
+	}
+}
+
+// setID returns a copy of the JSON-RPC message body with its "id" field
+// replaced by id.
+func setID(body []byte, id uint64) ([]byte, error) {
+	idBytes, err := json.Marshal(id)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal id")
+	}
+	return setIDRaw(body, idBytes)
+}
+
+// setIDRaw returns a copy of the JSON-RPC message body with its "id" field
+// replaced by the raw value id.
+func setIDRaw(body []byte, id json.RawMessage) ([]byte, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, errors.Wrap(err, "failed to parse message")
+	}
+	raw["id"] = id
+	rewritten, err := json.Marshal(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal message")
+	}
+	return rewritten, nil
+}
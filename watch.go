@@ -0,0 +1,271 @@
+// Copyright 2015 The Gorilla WebSocket Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/bmatcuk/doublestar/v4"
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+var (
+	watchFiles    = flag.Bool("watch-files", false, "watch the workspace root and synthesize workspace/didChangeWatchedFiles notifications (opt-in)")
+	watchDebounce = flag.Duration("watch-debounce", 200*time.Millisecond, "debounce window for coalescing filesystem events before notifying the language server")
+)
+
+// FileChangeType, as defined by the LSP base protocol.
+const (
+	fileChangeCreated = 1
+	fileChangeChanged = 2
+	fileChangeDeleted = 3
+)
+
+// fileWatcher watches a Server's workspace root with fsnotify and turns
+// matching filesystem events into workspace/didChangeWatchedFiles
+// notifications written to the server's stdin. The glob patterns it
+// matches against come from the language server's own
+// client/registerCapability request for workspace/didChangeWatchedFiles.
+type fileWatcher struct {
+	server  *Server
+	watcher *fsnotify.Watcher
+
+	mu       sync.Mutex
+	patterns []string
+
+	pendingMu sync.Mutex
+	pending   map[string]int // absolute path -> most recent FileChangeType
+	timer     *time.Timer
+}
+
+func startFileWatcher(s *Server) (*fileWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, errors.Wrap(err, "fsnotify")
+	}
+
+	err = filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return w.Add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		_ = w.Close()
+		return nil, errors.Wrap(err, "walk workspace root")
+	}
+
+	fw := &fileWatcher{
+		server:  s,
+		watcher: w,
+		pending: make(map[string]int),
+	}
+	go fw.run()
+
+	return fw, nil
+}
+
+func (fw *fileWatcher) run() {
+	for {
+		select {
+		case event, ok := <-fw.watcher.Events:
+			if !ok {
+				return
+			}
+			fw.handle(event)
+		case err, ok := <-fw.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("watch:", err)
+		}
+	}
+}
+
+func (fw *fileWatcher) handle(event fsnotify.Event) {
+	if event.Op&fsnotify.Create != 0 {
+		fw.watchIfDir(event.Name)
+	}
+
+	if !fw.matches(event.Name) {
+		return
+	}
+
+	var changeType int
+	switch {
+	case event.Op&fsnotify.Create != 0:
+		changeType = fileChangeCreated
+	case event.Op&fsnotify.Remove != 0 || event.Op&fsnotify.Rename != 0:
+		changeType = fileChangeDeleted
+	case event.Op&fsnotify.Write != 0:
+		changeType = fileChangeChanged
+	default:
+		return
+	}
+
+	path, err := filepath.Abs(event.Name)
+	if err != nil {
+		log.Println("watch:", err)
+		return
+	}
+
+	fw.pendingMu.Lock()
+	fw.pending[path] = changeType
+	if fw.timer == nil {
+		fw.timer = time.AfterFunc(*watchDebounce, fw.flush)
+	}
+	fw.pendingMu.Unlock()
+}
+
+// watchIfDir adds path to the watch set if it is a directory, so files
+// created inside it afterward are observed too; fsnotify does not recurse
+// into subdirectories on its own. It also walks path for any subdirectories
+// that already exist under it (e.g. a directory moved in or checked out as
+// a whole tree), since those arrive with their own contents already in
+// place and would otherwise never be added.
+func (fw *fileWatcher) watchIfDir(path string) {
+	info, err := os.Stat(path)
+	if err != nil || !info.IsDir() {
+		return
+	}
+
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return fw.watcher.Add(p)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("watch:", err)
+	}
+}
+
+func (fw *fileWatcher) flush() {
+	fw.pendingMu.Lock()
+	changes := fw.pending
+	fw.pending = make(map[string]int)
+	fw.timer = nil
+	fw.pendingMu.Unlock()
+
+	if len(changes) == 0 {
+		return
+	}
+
+	type fileEvent struct {
+		URI  string `json:"uri"`
+		Type int    `json:"type"`
+	}
+
+	events := make([]fileEvent, 0, len(changes))
+	for path, changeType := range changes {
+		events = append(events, fileEvent{URI: "file://" + path, Type: changeType})
+	}
+
+	notif, err := json.Marshal(struct {
+		Jsonrpc string `json:"jsonrpc"`
+		Method  string `json:"method"`
+		Params  struct {
+			Changes []fileEvent `json:"changes"`
+		} `json:"params"`
+	}{
+		Jsonrpc: "2.0",
+		Method:  "workspace/didChangeWatchedFiles",
+		Params: struct {
+			Changes []fileEvent `json:"changes"`
+		}{events},
+	})
+	if err != nil {
+		log.Println("watch:", err)
+		return
+	}
+
+	if err := fw.server.writeStdin(notif); err != nil {
+		log.Println("watch:", err)
+	}
+}
+
+// matches reports whether path satisfies one of the registered watch
+// patterns, checked against both the path relative to the workspace root
+// and the bare file name.
+func (fw *fileWatcher) matches(path string) bool {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if len(fw.patterns) == 0 {
+		return false
+	}
+
+	rel, err := filepath.Rel(fw.server.root, path)
+	if err != nil {
+		rel = path
+	}
+	rel = filepath.ToSlash(rel)
+	base := filepath.Base(path)
+
+	for _, pattern := range fw.patterns {
+		// doublestar.Match, unlike filepath.Match, treats "**" as
+		// matching across "/" boundaries, which is what the "**/*.go"
+		// style patterns real language servers register actually need.
+		if ok, _ := doublestar.Match(pattern, rel); ok {
+			return true
+		}
+		if ok, _ := doublestar.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// learn extracts workspace/didChangeWatchedFiles glob patterns from a
+// client/registerCapability request and adds them to the watched set.
+func (fw *fileWatcher) learn(env jsonrpcEnvelope) {
+	var params struct {
+		Registrations []struct {
+			Method          string `json:"method"`
+			RegisterOptions struct {
+				Watchers []struct {
+					GlobPattern string `json:"globPattern"`
+				} `json:"watchers"`
+			} `json:"registerOptions"`
+		} `json:"registrations"`
+	}
+	if err := json.Unmarshal(env.Params, &params); err != nil {
+		return
+	}
+
+	var patterns []string
+	for _, reg := range params.Registrations {
+		if reg.Method != "workspace/didChangeWatchedFiles" {
+			continue
+		}
+		for _, watcher := range reg.RegisterOptions.Watchers {
+			patterns = append(patterns, watcher.GlobPattern)
+		}
+	}
+	if len(patterns) == 0 {
+		return
+	}
+
+	fw.mu.Lock()
+	fw.patterns = append(fw.patterns, patterns...)
+	fw.mu.Unlock()
+}
+
+func (fw *fileWatcher) close() {
+	_ = fw.watcher.Close()
+}